@@ -0,0 +1,272 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2021-04-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const azureCSIDriver = "disk.csi.azure.com"
+
+// azureManagedTagsKey is Azure's equivalent of managedTagsKey. Azure tag
+// names can't contain "/", so a dot is used instead.
+const azureManagedTagsKey = "kube-tagger.managed-tags"
+
+var azureSubscriptionID = kingpin.Flag("azure-subscription-id", "Azure subscription id to use when a disk's resource ID doesn't encode one").String()
+
+type azureProvider struct{}
+
+func (azureProvider) Name() string { return "azure" }
+
+func (azureProvider) MarkerKey() string { return azureManagedTagsKey }
+
+func (azureProvider) Matches(pv *v1.PersistentVolume) bool {
+	if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == azureCSIDriver {
+		return true
+	}
+	return pv.Spec.AzureDisk != nil
+}
+
+func (azureProvider) Tag(ctx context.Context, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, tags map[string]string) error {
+	resourceID, err := azureDiskResourceID(pv)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot determine Azure disk resource ID")
+		providerErrors.WithLabelValues("azure").Inc()
+		return err
+	}
+	subscriptionID, resourceGroup, diskName, err := parseAzureDiskResourceID(resourceID)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot parse Azure disk resource ID")
+		providerErrors.WithLabelValues("azure").Inc()
+		return err
+	}
+
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot create Azure authorizer")
+		providerErrors.WithLabelValues("azure").Inc()
+		return err
+	}
+	disksClient := compute.NewDisksClient(subscriptionID)
+	disksClient.Authorizer = authorizer
+
+	disk, err := disksClient.Get(ctx, resourceGroup, diskName)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Cannot get Azure disk")
+		providerErrors.WithLabelValues("azure").Inc()
+		return err
+	}
+
+	merged := map[string]*string{}
+	for k, v := range disk.Tags {
+		merged[k] = v
+	}
+	var tagAdded bool
+	var newTags int
+	for k, v := range tags {
+		if existing, ok := merged[k]; ok && existing != nil && *existing == v {
+			tagsExisting.Inc()
+			continue
+		}
+		value := v
+		merged[k] = &value
+		tagAdded = true
+		newTags++
+	}
+	currentManaged := ""
+	if existing, ok := merged[azureManagedTagsKey]; ok && existing != nil {
+		currentManaged = *existing
+	}
+	if newManaged := encodeManagedKeys(tags, azureManagedTagsKey); newManaged != "" && newManaged != currentManaged {
+		merged[azureManagedTagsKey] = &newManaged
+		tagAdded = true
+	}
+
+	if !tagAdded {
+		return nil
+	}
+
+	future, err := disksClient.Update(ctx, resourceGroup, diskName, compute.DiskUpdate{Tags: merged})
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Error updating Azure disk tags")
+		providerErrors.WithLabelValues("azure").Inc()
+		return err
+	}
+	if err := waitForDiskUpdate(ctx, disksClient, future); err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Azure disk update operation failed")
+		providerErrors.WithLabelValues("azure").Inc()
+		return err
+	}
+	tagsAdded.Add(float64(newTags))
+	providerVolumesTagged.WithLabelValues("azure").Inc()
+	return nil
+}
+
+/*
+waitForDiskUpdate blocks until an Azure DisksClient.Update long-running
+operation completes, since submitting it only means ARM accepted the
+request, not that it succeeded.
+*/
+func waitForDiskUpdate(ctx context.Context, disksClient compute.DisksClient, future compute.DisksUpdateFuture) error {
+	if err := future.WaitForCompletionRef(ctx, disksClient.Client); err != nil {
+		return err
+	}
+	_, err := future.Result(disksClient)
+	return err
+}
+
+func (azureProvider) client(subscriptionID string) (compute.DisksClient, error) {
+	disksClient := compute.NewDisksClient(subscriptionID)
+	authorizer, err := auth.NewAuthorizerFromEnvironment()
+	if err != nil {
+		return disksClient, err
+	}
+	disksClient.Authorizer = authorizer
+	return disksClient, nil
+}
+
+func (p azureProvider) ManagedKeys(ctx context.Context, pv *v1.PersistentVolume) []string {
+	resourceID, err := azureDiskResourceID(pv)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot determine Azure disk resource ID")
+		providerErrors.WithLabelValues("azure").Inc()
+		return nil
+	}
+	subscriptionID, resourceGroup, diskName, err := parseAzureDiskResourceID(resourceID)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot parse Azure disk resource ID")
+		providerErrors.WithLabelValues("azure").Inc()
+		return nil
+	}
+
+	disksClient, err := p.client(subscriptionID)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot create Azure authorizer")
+		providerErrors.WithLabelValues("azure").Inc()
+		return nil
+	}
+
+	disk, err := disksClient.Get(ctx, resourceGroup, diskName)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Cannot get Azure disk")
+		providerErrors.WithLabelValues("azure").Inc()
+		return nil
+	}
+	if v, ok := disk.Tags[azureManagedTagsKey]; ok && v != nil {
+		return decodeManagedKeys(*v)
+	}
+	return nil
+}
+
+func (p azureProvider) Untag(ctx context.Context, pv *v1.PersistentVolume, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	resourceID, err := azureDiskResourceID(pv)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot determine Azure disk resource ID")
+		providerErrors.WithLabelValues("azure").Inc()
+		return
+	}
+	subscriptionID, resourceGroup, diskName, err := parseAzureDiskResourceID(resourceID)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot parse Azure disk resource ID")
+		providerErrors.WithLabelValues("azure").Inc()
+		return
+	}
+
+	disksClient, err := p.client(subscriptionID)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot create Azure authorizer")
+		providerErrors.WithLabelValues("azure").Inc()
+		return
+	}
+
+	disk, err := disksClient.Get(ctx, resourceGroup, diskName)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Cannot get Azure disk")
+		providerErrors.WithLabelValues("azure").Inc()
+		return
+	}
+
+	merged := map[string]*string{}
+	for k, v := range disk.Tags {
+		merged[k] = v
+	}
+	for _, k := range keys {
+		delete(merged, k)
+	}
+
+	future, err := disksClient.Update(ctx, resourceGroup, diskName, compute.DiskUpdate{Tags: merged})
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Error removing Azure disk tags")
+		providerErrors.WithLabelValues("azure").Inc()
+		return
+	}
+	if err := waitForDiskUpdate(ctx, disksClient, future); err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Azure disk update operation failed")
+		providerErrors.WithLabelValues("azure").Inc()
+		return
+	}
+	tagsRemoved.Add(float64(len(keys)))
+}
+
+func azureDiskResourceID(pv *v1.PersistentVolume) (string, error) {
+	if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == azureCSIDriver {
+		return pv.Spec.CSI.VolumeHandle, nil
+	}
+	if pv.Spec.AzureDisk != nil {
+		return pv.Spec.AzureDisk.DataDiskURI, nil
+	}
+	return "", fmt.Errorf("PV has no Azure disk source")
+}
+
+/*
+parseAzureDiskResourceID splits an ARM resource ID of the form
+/subscriptions/<sub>/resourceGroups/<rg>/providers/Microsoft.Compute/disks/<name>
+into its components. --azure-subscription-id is used as a fallback
+when the ID itself doesn't carry a subscription.
+*/
+func parseAzureDiskResourceID(id string) (subscriptionID string, resourceGroup string, diskName string, err error) {
+	parts := strings.Split(strings.Trim(id, "/"), "/")
+	for i := 0; i < len(parts)-1; i++ {
+		switch strings.ToLower(parts[i]) {
+		case "subscriptions":
+			subscriptionID = parts[i+1]
+		case "resourcegroups":
+			resourceGroup = parts[i+1]
+		case "disks":
+			diskName = parts[i+1]
+		}
+	}
+	if subscriptionID == "" {
+		subscriptionID = *azureSubscriptionID
+	}
+	if subscriptionID == "" || resourceGroup == "" || diskName == "" {
+		return "", "", "", fmt.Errorf("cannot parse Azure disk resource id: %s", id)
+	}
+	return subscriptionID, resourceGroup, diskName, nil
+}
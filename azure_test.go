@@ -0,0 +1,80 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func TestParseAzureDiskResourceID(t *testing.T) {
+	origAzureSubscriptionID := *azureSubscriptionID
+	defer func() { *azureSubscriptionID = origAzureSubscriptionID }()
+
+	tests := []struct {
+		name                string
+		id                  string
+		azureSubscriptionID string
+		wantSub             string
+		wantRG              string
+		wantDisk            string
+		wantErr             bool
+	}{
+		{
+			name:     "full ARM id",
+			id:       "/subscriptions/sub-1/resourceGroups/rg-1/providers/Microsoft.Compute/disks/disk-1",
+			wantSub:  "sub-1",
+			wantRG:   "rg-1",
+			wantDisk: "disk-1",
+		},
+		{
+			name:                "missing subscription falls back to flag",
+			id:                  "/resourceGroups/rg-1/providers/Microsoft.Compute/disks/disk-1",
+			azureSubscriptionID: "flag-sub",
+			wantSub:             "flag-sub",
+			wantRG:              "rg-1",
+			wantDisk:            "disk-1",
+		},
+		{
+			name:    "missing subscription and flag unset",
+			id:      "/resourceGroups/rg-1/providers/Microsoft.Compute/disks/disk-1",
+			wantErr: true,
+		},
+		{
+			name:    "missing resource group",
+			id:      "/subscriptions/sub-1/providers/Microsoft.Compute/disks/disk-1",
+			wantErr: true,
+		},
+		{
+			name:    "missing disk name",
+			id:      "/subscriptions/sub-1/resourceGroups/rg-1/providers/Microsoft.Compute",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*azureSubscriptionID = tt.azureSubscriptionID
+			gotSub, gotRG, gotDisk, err := parseAzureDiskResourceID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAzureDiskResourceID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if gotSub != tt.wantSub || gotRG != tt.wantRG || gotDisk != tt.wantDisk {
+				t.Errorf("parseAzureDiskResourceID() = (%q, %q, %q), want (%q, %q, %q)", gotSub, gotRG, gotDisk, tt.wantSub, tt.wantRG, tt.wantDisk)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var k8sTagClusterID = kingpin.Flag("k8s-tag-cluster-id", "Cluster ID used to write kubernetes.io/cluster/<id>=owned and kubernetes.io/created-for/* tags, matching the legacy in-tree AWS volume plugin. Detected from an existing KubernetesCluster or kubernetes.io/cluster/<id> tag on the volume if unset").String()
+
+const legacyClusterTag = "KubernetesCluster"
+const clusterTagPrefix = "kubernetes.io/cluster/"
+
+/*
+detectClusterID returns the cluster id kube-tagger should use for
+in-tree-compatible tags: the --k8s-tag-cluster-id flag if set,
+otherwise whatever is already recorded on the volume via the legacy
+KubernetesCluster tag or a kubernetes.io/cluster/<id> tag.
+*/
+func detectClusterID(existing []*ec2.Tag) string {
+	if *k8sTagClusterID != "" {
+		return *k8sTagClusterID
+	}
+	for _, t := range existing {
+		if *t.Key == legacyClusterTag {
+			return *t.Value
+		}
+		if strings.HasPrefix(*t.Key, clusterTagPrefix) {
+			return strings.TrimPrefix(*t.Key, clusterTagPrefix)
+		}
+	}
+	return ""
+}
+
+/*
+inTreeCompatTags returns the tags the legacy in-tree AWS volume plugin
+used to write for a PVC-backed EBS volume, so that clusters migrating
+to the EBS CSI driver keep their cost-allocation and cleanup
+automation working. Returns nil if clusterID is empty, meaning the
+feature isn't in use for this volume.
+*/
+func inTreeCompatTags(pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, clusterID string) map[string]string {
+	if clusterID == "" {
+		return nil
+	}
+	return map[string]string{
+		"kubernetes.io/created-for/pvc/name":      pvc.Name,
+		"kubernetes.io/created-for/pvc/namespace": pvc.Namespace,
+		"kubernetes.io/created-for/pv/name":       pv.Name,
+		clusterTagPrefix + clusterID:              "owned",
+	}
+}
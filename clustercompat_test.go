@@ -0,0 +1,112 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDetectClusterID(t *testing.T) {
+	origK8sTagClusterID := *k8sTagClusterID
+	defer func() { *k8sTagClusterID = origK8sTagClusterID }()
+
+	tests := []struct {
+		name     string
+		flag     string
+		existing []*ec2.Tag
+		want     string
+	}{
+		{
+			name: "flag takes precedence over existing tags",
+			flag: "flag-cluster",
+			existing: []*ec2.Tag{
+				{Key: aws.String(legacyClusterTag), Value: aws.String("legacy-cluster")},
+			},
+			want: "flag-cluster",
+		},
+		{
+			name: "legacy KubernetesCluster tag",
+			flag: "",
+			existing: []*ec2.Tag{
+				{Key: aws.String(legacyClusterTag), Value: aws.String("legacy-cluster")},
+			},
+			want: "legacy-cluster",
+		},
+		{
+			name: "kubernetes.io/cluster/<id> tag",
+			flag: "",
+			existing: []*ec2.Tag{
+				{Key: aws.String(clusterTagPrefix + "my-cluster"), Value: aws.String("owned")},
+			},
+			want: "my-cluster",
+		},
+		{
+			name:     "no flag and no existing tags",
+			flag:     "",
+			existing: nil,
+			want:     "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*k8sTagClusterID = tt.flag
+			if got := detectClusterID(tt.existing); got != tt.want {
+				t.Errorf("detectClusterID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInTreeCompatTags(t *testing.T) {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "my-pvc",
+		},
+	}
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "my-pv",
+		},
+	}
+
+	t.Run("empty cluster id returns nil", func(t *testing.T) {
+		if got := inTreeCompatTags(pvc, pv, ""); got != nil {
+			t.Errorf("inTreeCompatTags() = %v, want nil", got)
+		}
+	})
+
+	t.Run("cluster id set generates in-tree compat tags", func(t *testing.T) {
+		got := inTreeCompatTags(pvc, pv, "my-cluster")
+		want := map[string]string{
+			"kubernetes.io/created-for/pvc/name":      "my-pvc",
+			"kubernetes.io/created-for/pvc/namespace": "default",
+			"kubernetes.io/created-for/pv/name":       "my-pv",
+			clusterTagPrefix + "my-cluster":           "owned",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("inTreeCompatTags() = %v, want %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,405 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	resyncPeriod = kingpin.Flag("resync-period", "How often to fully resync every PVC, in addition to reacting to events").Default("10m").Duration()
+	workerCount  = kingpin.Flag("workers", "Number of worker goroutines processing the reconcile queue").Default("2").Int()
+
+	workqueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kubetagger_workqueue_depth",
+		Help: "Current depth of the PVC reconcile workqueue",
+	})
+	reconcileLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "kubetagger_reconcile_latency_seconds",
+		Help: "Time taken to reconcile a single PVC",
+	})
+)
+
+/*
+controller watches PersistentVolumeClaims through a shared informer and
+reconciles tags through a rate-limited workqueue. This survives API
+server restarts (the informer re-lists and re-watches transparently),
+retries failed reconciles with exponential backoff instead of crashing
+the process, and skips PVCs whose tag-relevant state hasn't actually
+changed since they were last reconciled.
+*/
+type controller struct {
+	clientset kubernetes.Interface
+	lister    corelisters.PersistentVolumeClaimLister
+	synced    cache.InformerSynced
+	queue     workqueue.RateLimitingInterface
+
+	// mu guards lastObserved and pendingDeletes. The workqueue only
+	// guarantees that two workers never process the same key concurrently;
+	// it does nothing to stop two workers handling different keys from
+	// touching these maps at the same time, so plain map access here would
+	// race with --workers > 1.
+	mu sync.Mutex
+
+	// lastObserved remembers the tag-relevant fingerprint kube-tagger last
+	// reconciled for a given PVC key, so a Modified event that doesn't
+	// touch annotations/labels we care about is a no-op.
+	lastObserved map[string]string
+
+	// pendingDeletes holds the last known state of PVCs that have been
+	// deleted, keyed the same way as the queue, since by the time sync
+	// runs the object is already gone from the lister.
+	pendingDeletes map[string]*v1.PersistentVolumeClaim
+}
+
+func newController(clientset kubernetes.Interface, pvcInformer coreinformers.PersistentVolumeClaimInformer) *controller {
+	c := &controller{
+		clientset:      clientset,
+		lister:         pvcInformer.Lister(),
+		synced:         pvcInformer.Informer().HasSynced,
+		queue:          workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		lastObserved:   map[string]string{},
+		pendingDeletes: map[string]*v1.PersistentVolumeClaim{},
+	}
+
+	pvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueue,
+		UpdateFunc: func(old, new interface{}) {
+			c.enqueue(new)
+		},
+		DeleteFunc: c.enqueueDelete,
+	})
+
+	return c
+}
+
+func (c *controller) getLastObserved(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fingerprint, ok := c.lastObserved[key]
+	return fingerprint, ok
+}
+
+func (c *controller) setLastObserved(key, fingerprint string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastObserved[key] = fingerprint
+}
+
+func (c *controller) deleteLastObserved(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.lastObserved, key)
+}
+
+func (c *controller) setPendingDelete(key string, pvc *v1.PersistentVolumeClaim) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pendingDeletes[key] = pvc
+}
+
+func (c *controller) peekPendingDelete(key string) *v1.PersistentVolumeClaim {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pendingDeletes[key]
+}
+
+func (c *controller) deletePendingDelete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pendingDeletes, key)
+}
+
+func (c *controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+	workqueueDepth.Set(float64(c.queue.Len()))
+}
+
+/*
+enqueueDelete handles a PVC Delete event. It stashes the last known PVC
+object in pendingDeletes, keyed the same way as the queue, so sync can
+still find the backing volume once the object itself is gone from the
+lister.
+*/
+func (c *controller) enqueueDelete(obj interface{}) {
+	pvc, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			runtime.HandleError(fmt.Errorf("unexpected object type in delete event: %T", obj))
+			return
+		}
+		pvc, ok = tombstone.Obj.(*v1.PersistentVolumeClaim)
+		if !ok {
+			runtime.HandleError(fmt.Errorf("tombstone contained unexpected object type: %T", tombstone.Obj))
+			return
+		}
+	}
+
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.setPendingDelete(key, pvc)
+	c.queue.Add(key)
+	workqueueDepth.Set(float64(c.queue.Len()))
+}
+
+/*
+run blocks, dispatching reconciles to workers workers until ctx is
+cancelled.
+*/
+func (c *controller) run(ctx context.Context, workers int) {
+	defer runtime.HandleCrash()
+	defer c.queue.ShutDown()
+
+	log.Info("Starting PVC controller")
+	if !cache.WaitForCacheSync(ctx.Done(), c.synced) {
+		log.Fatal("Timed out waiting for informer cache to sync")
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(func() { c.runWorker(ctx) }, time.Second, ctx.Done())
+	}
+
+	<-ctx.Done()
+	log.Info("Shutting down PVC controller")
+}
+
+func (c *controller) runWorker(ctx context.Context) {
+	for c.processNextWorkItem(ctx) {
+	}
+}
+
+func (c *controller) processNextWorkItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+	defer workqueueDepth.Set(float64(c.queue.Len()))
+
+	if err := c.sync(ctx, key.(string)); err != nil {
+		runtime.HandleError(fmt.Errorf("error syncing %q, requeuing: %w", key, err))
+		processingErrors.Inc()
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
+}
+
+/*
+sync reconciles a single PVC: it looks up the current object, skips
+re-tagging it if nothing tag-relevant has changed since last time, and
+otherwise dispatches it to the matching StorageProvider exactly as the
+old Watch loop did. When --prune is set, it also corrects drift on every
+call regardless of the fingerprint, and when --prune-on-delete is set and
+the PVC has been deleted it hands off to syncDelete.
+*/
+func (c *controller) sync(ctx context.Context, key string) error {
+	start := time.Now()
+	defer func() { reconcileLatency.Observe(time.Since(start).Seconds()) }()
+	eventsProcessed.Inc()
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	pvc, err := c.lister.PersistentVolumeClaims(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		logWithCtx(ctx).WithFields(log.Fields{"namespace": namespace, "volumeClaimName": name}).Info("Volume Claim no longer exists")
+		c.deleteLastObserved(key)
+		if deleted := c.peekPendingDelete(key); *pruneOnDelete && deleted != nil {
+			if err := c.syncDelete(ctx, deleted); err != nil {
+				return err
+			}
+		}
+		c.deletePendingDelete(key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	volumeClaim := *pvc
+	volumeName := volumeClaim.Spec.VolumeName
+
+	ctx = context.WithValue(ctx, ns, namespace)
+	ctx = context.WithValue(ctx, pvcname, name)
+	ctx = context.WithValue(ctx, volname, volumeName)
+
+	if isIgnored(&volumeClaim) {
+		logWithCtx(ctx).Info("Volume Claim is annotated to be ignored")
+		return nil
+	}
+
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(volumeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot find volume associated with Volume Claim: %w", err)
+	}
+
+	provider := findStorageProvider(pv)
+	if provider == nil {
+		logWithCtx(ctx).Warn("Volume is not provisioned by a supported storage provider. Ignoring")
+		return nil
+	}
+
+	fingerprint := pvcFingerprint(&volumeClaim)
+	observed, _ := c.getLastObserved(key)
+	unchanged := observed == fingerprint
+	if unchanged && !*prune {
+		logWithCtx(ctx).Debug("Nothing tag-relevant changed since last reconcile, skipping")
+		return nil
+	}
+
+	tags := buildTags(&volumeClaim)
+
+	// Drift is corrected before tagging, while the managed-tags marker
+	// still lists the previous keys; Tag rewrites the marker.
+	if *prune {
+		c.correctDrift(ctx, provider, pv, tags)
+	}
+
+	if !unchanged {
+		logWithCtx(ctx).Info("Processing Volume Tags")
+		if len(tags) > 0 {
+			if !*dryrun {
+				if err := provider.Tag(ctx, &volumeClaim, pv, tags); err != nil {
+					return fmt.Errorf("cannot tag volume: %w", err)
+				}
+			} else {
+				logWithCtx(ctx).WithFields(log.Fields{"tags": tags, "provider": provider.Name()}).Info("Running in dry run mode, not adding tags")
+			}
+		}
+	}
+
+	c.setLastObserved(key, fingerprint)
+	return nil
+}
+
+/*
+syncDelete removes the tags kube-tagger previously applied on behalf of
+a now-deleted PVC. The PV may already be gone too (e.g. a Delete reclaim
+policy raced us), in which case there's nothing left to untag.
+*/
+func (c *controller) syncDelete(ctx context.Context, pvc *v1.PersistentVolumeClaim) error {
+	volumeName := pvc.Spec.VolumeName
+	if volumeName == "" {
+		return nil
+	}
+
+	ctx = context.WithValue(ctx, ns, pvc.Namespace)
+	ctx = context.WithValue(ctx, pvcname, pvc.Name)
+	ctx = context.WithValue(ctx, volname, volumeName)
+
+	pv, err := c.clientset.CoreV1().PersistentVolumes().Get(volumeName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot find volume associated with deleted Volume Claim: %w", err)
+	}
+
+	provider := findStorageProvider(pv)
+	if provider == nil {
+		return nil
+	}
+
+	keys := provider.ManagedKeys(ctx, pv)
+	if len(keys) == 0 {
+		return nil
+	}
+
+	logWithCtx(ctx).WithFields(log.Fields{"tagKeys": keys, "provider": provider.Name()}).Info("Volume Claim deleted, removing managed tags")
+	if *dryrun {
+		logWithCtx(ctx).Info("Running in dry run mode, not removing tags")
+		return nil
+	}
+	provider.Untag(ctx, pv, append(keys, provider.MarkerKey()))
+	return nil
+}
+
+/*
+correctDrift removes managed tags that kube-tagger applied previously
+but that desired (the tags currently built from the PVC) no longer
+calls for, e.g. because a tagging annotation was edited or removed.
+Only keys the managed-tags marker itself records are ever touched. When
+desired is empty, the marker itself is also cleared: Tag is never
+called in that case, so nothing else would ever rewrite it, and leaving
+it behind would make the now-stale keys it lists reappear on every
+future resync.
+*/
+func (c *controller) correctDrift(ctx context.Context, provider StorageProvider, pv *v1.PersistentVolume, desired map[string]string) {
+	managed := provider.ManagedKeys(ctx, pv)
+	stale := staleManagedKeys(managed, desired)
+	if len(desired) == 0 && len(managed) > 0 {
+		stale = append(stale, provider.MarkerKey())
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	logWithCtx(ctx).WithFields(log.Fields{"tagKeys": stale, "provider": provider.Name()}).Info("Removing stale managed tags")
+	if *dryrun {
+		logWithCtx(ctx).Info("Running in dry run mode, not removing tags")
+		return
+	}
+	provider.Untag(ctx, pv, stale)
+	tagsDriftCorrected.Add(float64(len(stale)))
+}
+
+/*
+pvcFingerprint captures the parts of a PVC that influence what gets
+tagged, so the controller can tell a tag-relevant Modified event from
+one that e.g. only updates status or an unrelated annotation.
+*/
+func pvcFingerprint(pvc *v1.PersistentVolumeClaim) string {
+	return fmt.Sprintf("%q|%q|%v",
+		pvc.Annotations["volume.beta.kubernetes.io/additional-resource-tags"],
+		pvc.Annotations["volume.beta.kubernetes.io/additional-resource-tags-separator"],
+		pvc.Labels)
+}
@@ -0,0 +1,250 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/option"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const gceCSIDriver = "pd.csi.storage.gke.io"
+
+// gceManagedTagsKey is GCE's equivalent of managedTagsKey. GCE label keys
+// can't contain "/", so a dash is used instead.
+const gceManagedTagsKey = "kube-tagger-managed-tags"
+
+var (
+	gcpCredentials = kingpin.Flag("gcp-credentials", "Path to a GCP service account JSON key file. If unset, Application Default Credentials are used").String()
+	gcpProject     = kingpin.Flag("gcp-project", "GCP project to use for in-tree GCEPersistentDisk volumes, which don't encode a project").String()
+	gcpZone        = kingpin.Flag("gcp-zone", "GCP zone to use for in-tree GCEPersistentDisk volumes, which don't encode a zone").String()
+)
+
+type gceProvider struct{}
+
+func (gceProvider) Name() string { return "gce" }
+
+func (gceProvider) MarkerKey() string { return gceManagedTagsKey }
+
+func (gceProvider) Matches(pv *v1.PersistentVolume) bool {
+	if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == gceCSIDriver {
+		return true
+	}
+	return pv.Spec.GCEPersistentDisk != nil
+}
+
+func (gceProvider) Tag(ctx context.Context, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, tags map[string]string) error {
+	project, zone, diskName, err := gceDiskLocation(pv)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot determine GCE disk location")
+		providerErrors.WithLabelValues("gce").Inc()
+		return err
+	}
+
+	var opts []option.ClientOption
+	if *gcpCredentials != "" {
+		opts = append(opts, option.WithCredentialsFile(*gcpCredentials))
+	}
+	svc, err := compute.NewService(ctx, opts...)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot create GCE compute client")
+		providerErrors.WithLabelValues("gce").Inc()
+		return err
+	}
+
+	disk, err := svc.Disks.Get(project, zone, diskName).Context(ctx).Do()
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Cannot get GCE disk")
+		providerErrors.WithLabelValues("gce").Inc()
+		return err
+	}
+
+	labels := map[string]string{}
+	for k, v := range disk.Labels {
+		labels[k] = v
+	}
+	var tagAdded bool
+	var newLabels int
+	for k, v := range tags {
+		if labels[k] == v {
+			tagsExisting.Inc()
+			continue
+		}
+		labels[k] = v
+		tagAdded = true
+		newLabels++
+	}
+	if newManaged := encodeManagedKeys(tags, gceManagedTagsKey); newManaged != "" && newManaged != labels[gceManagedTagsKey] {
+		labels[gceManagedTagsKey] = newManaged
+		tagAdded = true
+	}
+
+	if !tagAdded {
+		return nil
+	}
+
+	op, err := svc.Disks.SetLabels(project, zone, diskName, &compute.ZoneSetLabelsRequest{
+		Labels:           labels,
+		LabelFingerprint: disk.LabelFingerprint,
+	}).Context(ctx).Do()
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Error setting GCE disk labels")
+		providerErrors.WithLabelValues("gce").Inc()
+		return err
+	}
+	if err := waitForZoneOperation(ctx, svc, project, zone, op); err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("GCE SetLabels operation failed")
+		providerErrors.WithLabelValues("gce").Inc()
+		return err
+	}
+	tagsAdded.Add(float64(newLabels))
+	providerVolumesTagged.WithLabelValues("gce").Inc()
+	return nil
+}
+
+func (gceProvider) client(ctx context.Context) (*compute.Service, error) {
+	var opts []option.ClientOption
+	if *gcpCredentials != "" {
+		opts = append(opts, option.WithCredentialsFile(*gcpCredentials))
+	}
+	return compute.NewService(ctx, opts...)
+}
+
+func (p gceProvider) ManagedKeys(ctx context.Context, pv *v1.PersistentVolume) []string {
+	project, zone, diskName, err := gceDiskLocation(pv)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot determine GCE disk location")
+		providerErrors.WithLabelValues("gce").Inc()
+		return nil
+	}
+
+	svc, err := p.client(ctx)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot create GCE compute client")
+		providerErrors.WithLabelValues("gce").Inc()
+		return nil
+	}
+
+	disk, err := svc.Disks.Get(project, zone, diskName).Context(ctx).Do()
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Cannot get GCE disk")
+		providerErrors.WithLabelValues("gce").Inc()
+		return nil
+	}
+	return decodeManagedKeys(disk.Labels[gceManagedTagsKey])
+}
+
+func (p gceProvider) Untag(ctx context.Context, pv *v1.PersistentVolume, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	project, zone, diskName, err := gceDiskLocation(pv)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot determine GCE disk location")
+		providerErrors.WithLabelValues("gce").Inc()
+		return
+	}
+
+	svc, err := p.client(ctx)
+	if err != nil {
+		logWithCtx(ctx).WithError(err).Error("Cannot create GCE compute client")
+		providerErrors.WithLabelValues("gce").Inc()
+		return
+	}
+
+	disk, err := svc.Disks.Get(project, zone, diskName).Context(ctx).Do()
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Cannot get GCE disk")
+		providerErrors.WithLabelValues("gce").Inc()
+		return
+	}
+
+	labels := map[string]string{}
+	for k, v := range disk.Labels {
+		labels[k] = v
+	}
+	for _, k := range keys {
+		delete(labels, k)
+	}
+
+	op, err := svc.Disks.SetLabels(project, zone, diskName, &compute.ZoneSetLabelsRequest{
+		Labels:           labels,
+		LabelFingerprint: disk.LabelFingerprint,
+	}).Context(ctx).Do()
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("Error removing GCE disk labels")
+		providerErrors.WithLabelValues("gce").Inc()
+		return
+	}
+	if err := waitForZoneOperation(ctx, svc, project, zone, op); err != nil {
+		logWithCtx(ctx).WithError(err).WithField("disk", diskName).Error("GCE SetLabels operation failed")
+		providerErrors.WithLabelValues("gce").Inc()
+		return
+	}
+	tagsRemoved.Add(float64(len(keys)))
+}
+
+/*
+waitForZoneOperation blocks until the given zonal GCE operation reaches
+a terminal state, since Disks.SetLabels only submits the request and
+returns immediately. Returns an error if the operation itself failed,
+distinct from an error submitting it.
+*/
+func waitForZoneOperation(ctx context.Context, svc *compute.Service, project, zone string, op *compute.Operation) error {
+	name := op.Name
+	for op.Status != "DONE" {
+		var err error
+		op, err = svc.ZoneOperations.Wait(project, zone, name).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("waiting for GCE operation %s: %w", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("GCE operation %s failed: %s", op.Name, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+/*
+gceDiskLocation resolves the project, zone and disk name for pv. CSI
+volume handles encode all three ("projects/<p>/zones/<z>/disks/<n>");
+in-tree GCEPersistentDisk volumes only carry the disk name, so
+--gcp-project/--gcp-zone fill the gap.
+*/
+func gceDiskLocation(pv *v1.PersistentVolume) (project string, zone string, diskName string, err error) {
+	if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == gceCSIDriver {
+		parts := strings.Split(pv.Spec.CSI.VolumeHandle, "/")
+		if len(parts) != 6 {
+			return "", "", "", fmt.Errorf("unexpected GCE volume handle: %s", pv.Spec.CSI.VolumeHandle)
+		}
+		return parts[1], parts[3], parts[5], nil
+	}
+	if pv.Spec.GCEPersistentDisk != nil {
+		if *gcpProject == "" || *gcpZone == "" {
+			return "", "", "", fmt.Errorf("in-tree GCEPersistentDisk volume requires --gcp-project and --gcp-zone")
+		}
+		return *gcpProject, *gcpZone, pv.Spec.GCEPersistentDisk.PDName, nil
+	}
+	return "", "", "", fmt.Errorf("PV has no GCE disk source")
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestGceDiskLocation(t *testing.T) {
+	origGcpProject, origGcpZone := *gcpProject, *gcpZone
+	defer func() { *gcpProject, *gcpZone = origGcpProject, origGcpZone }()
+
+	tests := []struct {
+		name       string
+		pv         *v1.PersistentVolume
+		gcpProject string
+		gcpZone    string
+		wantProj   string
+		wantZone   string
+		wantDisk   string
+		wantErr    bool
+	}{
+		{
+			name: "CSI volume handle",
+			pv: &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: gceCSIDriver, VolumeHandle: "projects/my-project/zones/us-central1-a/disks/my-disk"},
+				},
+			}},
+			wantProj: "my-project",
+			wantZone: "us-central1-a",
+			wantDisk: "my-disk",
+		},
+		{
+			name: "malformed CSI volume handle",
+			pv: &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: gceCSIDriver, VolumeHandle: "my-project/my-disk"},
+				},
+			}},
+			wantErr: true,
+		},
+		{
+			name: "in-tree GCEPersistentDisk with flags set",
+			pv: &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "my-disk"},
+				},
+			}},
+			gcpProject: "flag-project",
+			gcpZone:    "flag-zone",
+			wantProj:   "flag-project",
+			wantZone:   "flag-zone",
+			wantDisk:   "my-disk",
+		},
+		{
+			name: "in-tree GCEPersistentDisk without flags set",
+			pv: &v1.PersistentVolume{Spec: v1.PersistentVolumeSpec{
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{PDName: "my-disk"},
+				},
+			}},
+			wantErr: true,
+		},
+		{
+			name:    "PV with no GCE disk source",
+			pv:      &v1.PersistentVolume{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*gcpProject, *gcpZone = tt.gcpProject, tt.gcpZone
+			project, zone, diskName, err := gceDiskLocation(tt.pv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("gceDiskLocation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if project != tt.wantProj || zone != tt.wantZone || diskName != tt.wantDisk {
+				t.Errorf("gceDiskLocation() = (%q, %q, %q), want (%q, %q, %q)", project, zone, diskName, tt.wantProj, tt.wantZone, tt.wantDisk)
+			}
+		})
+	}
+}
@@ -18,14 +18,15 @@ package main
 
 import (
 	"context"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -106,7 +107,8 @@ func main() {
 		http.ListenAndServe(":2112", nil)
 	}()
 
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	var config *rest.Config
 	var err error
@@ -129,81 +131,20 @@ func main() {
 		logWithCtx(ctx).WithError(err).Fatal("Error creating clientset")
 	}
 
-	watcher, err := clientset.CoreV1().PersistentVolumeClaims("").Watch(metav1.ListOptions{})
-	if err != nil {
-		logWithCtx(ctx).WithError(err).Fatal("Error creating PVC watcher")
-	}
-	/* changes */
-	ch := watcher.ResultChan()
-
-	for event := range ch {
-		eventsProcessed.Inc()
-		pvc, ok := event.Object.(*v1.PersistentVolumeClaim)
-		if !ok {
-			logWithCtx(ctx).Fatal("Unexpected event type")
-		}
-		if event.Type == watch.Added || event.Type == watch.Modified {
-			namespace := pvc.GetNamespace()
-			volumeClaimName := pvc.GetName()
-			volumeClaim := *pvc
-			volumeName := volumeClaim.Spec.VolumeName
-
-			ctx = context.WithValue(ctx, ns, namespace)
-			ctx = context.WithValue(ctx, pvcname, volumeClaimName)
-			ctx = context.WithValue(ctx, volname, volumeName)
-
-			awsVolume, errp := clientset.CoreV1().PersistentVolumes().Get(volumeName, metav1.GetOptions{})
-			if errp != nil {
-				logWithCtx(ctx).WithError(errp).Error("Cannot find EBS volume associated with Volume Claim")
-				processingErrors.Inc()
-				continue
-			}
-			awsVolumeID := awsVolume.Spec.PersistentVolumeSource.AWSElasticBlockStore.VolumeID
-			logWithCtx(ctx).Info("Processing Volume Tags")
-			if isEBSVolume(&volumeClaim) {
-				separator := ","
-				tagsToAdd := ""
-				for k, v := range volumeClaim.Annotations {
-					if k == "volume.beta.kubernetes.io/additional-resource-tags-separator" {
-						separator = v
-					}
-
-					if k == "volume.beta.kubernetes.io/additional-resource-tags" {
-						tagsToAdd = v
-					}
-				}
-				if tagsToAdd != "" {
-					if !*dryrun {
-						addAWSTags(ctx, tagsToAdd, awsVolumeID, separator)
-					} else {
-						logWithCtx(ctx).WithFields(log.Fields{"tags": tagsToAdd, "volId": awsVolumeID}).Info("Running in dry run mode, not adding tags")
-					}
-
-				}
-			} else {
-				logWithCtx(ctx).Warn("Volume is not EBS. Ignoring")
-			}
-		}
-	}
-}
+	informerFactory := informers.NewSharedInformerFactory(clientset, *resyncPeriod)
+	pvcController := newController(clientset, informerFactory.Core().V1().PersistentVolumeClaims())
 
-/*
-	This only works for EBS volumes. Make sure they are!
-*/
-func isEBSVolume(volume *v1.PersistentVolumeClaim) bool {
-	for k, v := range volume.Annotations {
-		if k == "volume.beta.kubernetes.io/storage-provisioner" && v == "kubernetes.io/aws-ebs" {
-			return true
-		}
-	}
-	return false
+	informerFactory.Start(ctx.Done())
+	pvcController.run(ctx, *workerCount)
 }
 
 /*
-	Loops through the tags found for the volume and calls `setTag`
-	to add it via the AWS api
+Loops through the tags found for the volume and calls `setTag`
+to add it via the AWS api. If a cluster id is configured or can be
+detected from the volume's existing tags, the in-tree-compatible
+created-for/cluster tags are merged in too.
 */
-func addAWSTags(ctx context.Context, awsTags string, awsVolumeID string, separator string) {
+func addAWSTags(ctx context.Context, tags map[string]string, awsVolumeID string, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) error {
 
 	var tagAdded = false
 	awsRegion, awsVolume := splitVol(awsVolumeID)
@@ -222,36 +163,55 @@ func addAWSTags(ctx context.Context, awsTags string, awsVolumeID string, separat
 		VolumeIds: []*string{&awsVolume},
 	}
 
-	tags := strings.Split(awsTags, separator)
-
 	resp, err := svc.DescribeVolumes(params)
 	if err != nil {
 		logWithCtx(ctx).WithError(err).WithFields(log.Fields{"volId": awsVolume, "region": awsRegion}).Error("Cannot get volume")
 		processingErrors.Inc()
-		return
+		return err
 	}
-	for i := range tags {
-		t := strings.Split(tags[i], "=")
-		if len(t) != 2 {
-			logWithCtx(ctx).Error("Skipping malformed tag")
-			processingErrors.Inc()
-			continue
-		}
-		logWithCtx(ctx).WithFields(log.Fields{"tagKey": t[0], "tagValue": t[1], "volId": awsVolume, "region": awsRegion}).Info("Processing EBS Volume")
-		if !hasTag(ctx, resp.Volumes[0].Tags, t[0], t[1], awsVolume, awsRegion) {
+
+	clusterID := detectClusterID(resp.Volumes[0].Tags)
+	allTags := map[string]string{}
+	for k, v := range tags {
+		allTags[k] = v
+	}
+	for k, v := range inTreeCompatTags(pvc, pv, clusterID) {
+		allTags[k] = v
+	}
+
+	var firstErr error
+	for k, v := range allTags {
+		logWithCtx(ctx).WithFields(log.Fields{"tagKey": k, "tagValue": v, "volId": awsVolume, "region": awsRegion}).Info("Processing EBS Volume")
+		if !hasTag(ctx, resp.Volumes[0].Tags, k, v, awsVolume, awsRegion) {
 			tagAdded = true
-			setTag(ctx, svc, t[0], t[1], awsVolume)
+			if err := setTag(ctx, svc, k, v, awsVolume); err != nil && firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
+
+	currentManaged := ""
+	for _, t := range resp.Volumes[0].Tags {
+		if *t.Key == managedTagsKey {
+			currentManaged = *t.Value
+		}
+	}
+	if newManaged := encodeManagedKeys(tags, managedTagsKey); newManaged != "" && newManaged != currentManaged {
+		if err := setTag(ctx, svc, managedTagsKey, newManaged, awsVolume); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
 	if tagAdded {
 		volumesTagged.Inc()
 	}
+	return firstErr
 }
 
 /*
-	AWS api call to set the tag found in the annotations
+AWS api call to set the tag found in the annotations
 */
-func setTag(ctx context.Context, svc *ec2.EC2, tagKey string, tagValue string, volumeID string) bool {
+func setTag(ctx context.Context, svc *ec2.EC2, tagKey string, tagValue string, volumeID string) error {
 	tags := &ec2.CreateTagsInput{
 		Resources: []*string{
 			aws.String(volumeID),
@@ -265,20 +225,21 @@ func setTag(ctx context.Context, svc *ec2.EC2, tagKey string, tagValue string, v
 	}
 	ret, err := svc.CreateTags(tags)
 	if err != nil {
-		logWithCtx(ctx).WithError(err).WithFields(log.Fields{"volId": volumeID}).Fatal("Error creating tags")
-		return false
+		logWithCtx(ctx).WithError(err).WithFields(log.Fields{"volId": volumeID}).Error("Error creating tags")
+		processingErrors.Inc()
+		return err
 	}
 	if *debug {
 		logWithCtx(ctx).Debugf("Returned value from CreatesTags call: %v", ret)
 	}
 	tagsAdded.Inc()
-	return true
+	return nil
 }
 
 /*
-   Check if the tag is already set. It wouldn't be a problem if it is
-   but if you're using cloudtrail it may be an issue seeing it
-   being set all muiltiple times
+Check if the tag is already set. It wouldn't be a problem if it is
+but if you're using cloudtrail it may be an issue seeing it
+being set all muiltiple times
 */
 func hasTag(ctx context.Context, tags []*ec2.Tag, key string, value string, awsVolume string, awsRegion string) bool {
 	for i := range tags {
@@ -291,7 +252,8 @@ func hasTag(ctx context.Context, tags []*ec2.Tag, key string, value string, awsV
 	return false
 }
 
-/* Take a URL as returned by Kubernetes in the format
+/*
+	Take a URL as returned by Kubernetes in the format
 
 aws://eu-west-1b/vol-7iyw8ygidg
 
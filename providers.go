@@ -0,0 +1,513 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/efs"
+	"github.com/aws/aws-sdk-go/service/fsx"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	providerVolumesTagged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubetagger_provider_volumes_tagged",
+		Help: "Number of volumes tagged by kubetagger, broken down by storage provider",
+	}, []string{"provider"})
+	providerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubetagger_provider_errors",
+		Help: "Number of errors while processing, broken down by storage provider",
+	}, []string{"provider"})
+)
+
+// StorageProvider recognises PVs backed by a particular cloud storage
+// backend (AWS, GCP, Azure, ...) and knows how to tag the underlying
+// resource.
+type StorageProvider interface {
+	// Name identifies the provider for logging and metrics.
+	Name() string
+	// Matches returns true if pv is backed by this provider's storage,
+	// based on its PersistentVolumeSource. This works for both
+	// dynamically-provisioned and statically-bound volumes, unlike keying
+	// off a provisioner annotation that's only ever written by dynamic
+	// provisioning.
+	Matches(pv *v1.PersistentVolume) bool
+	// Tag applies tags to the volume backing pv, which was claimed by pvc.
+	// An error means the tags may not have been fully applied, and the
+	// caller should retry.
+	Tag(ctx context.Context, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, tags map[string]string) error
+	// ManagedKeys returns the tag keys kube-tagger previously recorded as
+	// under its management for the volume backing pv.
+	ManagedKeys(ctx context.Context, pv *v1.PersistentVolume) []string
+	// Untag removes the given tag keys from the volume backing pv.
+	Untag(ctx context.Context, pv *v1.PersistentVolume, keys []string)
+	// MarkerKey returns the tag/label key this provider writes the
+	// managed-tags marker under, so callers can clear the marker itself
+	// (via Untag) once it no longer lists any keys.
+	MarkerKey() string
+}
+
+// storageProviders lists the providers the controller dispatches to, in
+// order. The first match wins.
+var storageProviders = []StorageProvider{
+	ebsProvider{},
+	efsProvider{},
+	fsxProvider{},
+	gceProvider{},
+	azureProvider{},
+}
+
+// findStorageProvider returns the provider that recognises pv, or nil if
+// none of them do.
+func findStorageProvider(pv *v1.PersistentVolume) StorageProvider {
+	for _, p := range storageProviders {
+		if p.Matches(pv) {
+			return p
+		}
+	}
+	return nil
+}
+
+/* EBS */
+
+type ebsProvider struct{}
+
+func (ebsProvider) Name() string { return "ebs" }
+
+func (ebsProvider) MarkerKey() string { return managedTagsKey }
+
+// Matches returns true for in-tree EBS volumes. EBS volumes provisioned
+// through the ebs.csi.aws.com CSI driver aren't handled by this provider.
+func (ebsProvider) Matches(pv *v1.PersistentVolume) bool {
+	return pv.Spec.PersistentVolumeSource.AWSElasticBlockStore != nil
+}
+
+func (ebsProvider) Tag(ctx context.Context, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, tags map[string]string) error {
+	if pv.Spec.PersistentVolumeSource.AWSElasticBlockStore == nil {
+		logWithCtx(ctx).Error("PV has no AWSElasticBlockStore source")
+		providerErrors.WithLabelValues("ebs").Inc()
+		return fmt.Errorf("PV has no AWSElasticBlockStore source")
+	}
+	awsVolumeID := pv.Spec.PersistentVolumeSource.AWSElasticBlockStore.VolumeID
+	if err := addAWSTags(ctx, tags, awsVolumeID, pvc, pv); err != nil {
+		return err
+	}
+	providerVolumesTagged.WithLabelValues("ebs").Inc()
+	return nil
+}
+
+func (ebsProvider) ManagedKeys(ctx context.Context, pv *v1.PersistentVolume) []string {
+	if pv.Spec.PersistentVolumeSource.AWSElasticBlockStore == nil {
+		return nil
+	}
+	awsRegion, awsVolume := splitVol(pv.Spec.PersistentVolumeSource.AWSElasticBlockStore.VolumeID)
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(awsRegion)})
+	if err != nil {
+		panic(err)
+	}
+	svc := ec2.New(sess)
+
+	resp, err := svc.DescribeVolumes(&ec2.DescribeVolumesInput{VolumeIds: []*string{&awsVolume}})
+	if err != nil || len(resp.Volumes) == 0 {
+		logWithCtx(ctx).WithError(err).WithField("volId", awsVolume).Error("Cannot get volume")
+		providerErrors.WithLabelValues("ebs").Inc()
+		return nil
+	}
+	for _, t := range resp.Volumes[0].Tags {
+		if *t.Key == managedTagsKey {
+			return decodeManagedKeys(*t.Value)
+		}
+	}
+	return nil
+}
+
+func (ebsProvider) Untag(ctx context.Context, pv *v1.PersistentVolume, keys []string) {
+	if pv.Spec.PersistentVolumeSource.AWSElasticBlockStore == nil || len(keys) == 0 {
+		return
+	}
+	awsRegion, awsVolume := splitVol(pv.Spec.PersistentVolumeSource.AWSElasticBlockStore.VolumeID)
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(awsRegion)})
+	if err != nil {
+		panic(err)
+	}
+	svc := ec2.New(sess)
+
+	ec2Tags := make([]*ec2.Tag, 0, len(keys))
+	for _, k := range keys {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k)})
+	}
+	_, err = svc.DeleteTags(&ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(awsVolume)},
+		Tags:      ec2Tags,
+	})
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("volId", awsVolume).Error("Error removing EBS tags")
+		providerErrors.WithLabelValues("ebs").Inc()
+		return
+	}
+	tagsRemoved.Add(float64(len(keys)))
+}
+
+/* EFS */
+
+type efsProvider struct{}
+
+func (efsProvider) Name() string { return "efs" }
+
+func (efsProvider) MarkerKey() string { return managedTagsKey }
+
+const efsCSIDriver = "efs.csi.aws.com"
+
+func (efsProvider) Matches(pv *v1.PersistentVolume) bool {
+	return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == efsCSIDriver
+}
+
+/*
+Tags the EFS filesystem backing pv. EFS volume handles don't carry a
+region the way in-tree EBS ones do, so the AWS SDK's usual region
+resolution (env vars, shared config, instance metadata) is used instead.
+*/
+func (efsProvider) Tag(ctx context.Context, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, tags map[string]string) error {
+	if pv.Spec.CSI == nil {
+		logWithCtx(ctx).Error("PV has no CSI source")
+		providerErrors.WithLabelValues("efs").Inc()
+		return fmt.Errorf("PV has no CSI source")
+	}
+	fileSystemID := pv.Spec.CSI.VolumeHandle
+
+	sess, err := session.NewSession(&aws.Config{})
+	if err != nil {
+		panic(err)
+	}
+	svc := efs.New(sess)
+
+	existing, err := svc.DescribeTags(&efs.DescribeTagsInput{FileSystemId: aws.String(fileSystemID)})
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Cannot get EFS filesystem")
+		providerErrors.WithLabelValues("efs").Inc()
+		return err
+	}
+
+	var tagAdded bool
+	var firstErr error
+	for k, v := range tags {
+		if hasEFSTag(existing.Tags, k, v) {
+			tagsExisting.Inc()
+			continue
+		}
+		_, err := svc.CreateTags(&efs.CreateTagsInput{
+			FileSystemId: aws.String(fileSystemID),
+			Tags: []*efs.Tag{
+				{Key: aws.String(k), Value: aws.String(v)},
+			},
+		})
+		if err != nil {
+			logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Error creating EFS tags")
+			providerErrors.WithLabelValues("efs").Inc()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		tagsAdded.Inc()
+		tagAdded = true
+	}
+
+	currentManaged := ""
+	for _, t := range existing.Tags {
+		if *t.Key == managedTagsKey {
+			currentManaged = *t.Value
+		}
+	}
+	if newManaged := encodeManagedKeys(tags, managedTagsKey); newManaged != "" && newManaged != currentManaged {
+		_, err := svc.CreateTags(&efs.CreateTagsInput{
+			FileSystemId: aws.String(fileSystemID),
+			Tags: []*efs.Tag{
+				{Key: aws.String(managedTagsKey), Value: aws.String(newManaged)},
+			},
+		})
+		if err != nil {
+			logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Error updating EFS managed-tags marker")
+			providerErrors.WithLabelValues("efs").Inc()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if tagAdded {
+		providerVolumesTagged.WithLabelValues("efs").Inc()
+	}
+	return firstErr
+}
+
+func hasEFSTag(tags []*efs.Tag, key string, value string) bool {
+	for _, t := range tags {
+		if *t.Key == key && *t.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (efsProvider) ManagedKeys(ctx context.Context, pv *v1.PersistentVolume) []string {
+	if pv.Spec.CSI == nil {
+		return nil
+	}
+	fileSystemID := pv.Spec.CSI.VolumeHandle
+
+	sess, err := session.NewSession(&aws.Config{})
+	if err != nil {
+		panic(err)
+	}
+	svc := efs.New(sess)
+
+	existing, err := svc.DescribeTags(&efs.DescribeTagsInput{FileSystemId: aws.String(fileSystemID)})
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Cannot get EFS filesystem")
+		providerErrors.WithLabelValues("efs").Inc()
+		return nil
+	}
+	for _, t := range existing.Tags {
+		if *t.Key == managedTagsKey {
+			return decodeManagedKeys(*t.Value)
+		}
+	}
+	return nil
+}
+
+func (efsProvider) Untag(ctx context.Context, pv *v1.PersistentVolume, keys []string) {
+	if pv.Spec.CSI == nil || len(keys) == 0 {
+		return
+	}
+	fileSystemID := pv.Spec.CSI.VolumeHandle
+
+	sess, err := session.NewSession(&aws.Config{})
+	if err != nil {
+		panic(err)
+	}
+	svc := efs.New(sess)
+
+	for _, k := range keys {
+		_, err := svc.DeleteTags(&efs.DeleteTagsInput{
+			FileSystemId: aws.String(fileSystemID),
+			TagKeys:      []*string{aws.String(k)},
+		})
+		if err != nil {
+			logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Error removing EFS tags")
+			providerErrors.WithLabelValues("efs").Inc()
+			continue
+		}
+		tagsRemoved.Inc()
+	}
+}
+
+/* FSx */
+
+type fsxProvider struct{}
+
+func (fsxProvider) Name() string { return "fsx" }
+
+func (fsxProvider) MarkerKey() string { return managedTagsKey }
+
+const fsxCSIDriver = "fsx.csi.aws.com"
+
+func (fsxProvider) Matches(pv *v1.PersistentVolume) bool {
+	return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == fsxCSIDriver
+}
+
+/*
+Tags the FSx filesystem backing pv. TagResource needs a full resource
+ARN, so the filesystem is described first to look it up.
+*/
+func (fsxProvider) Tag(ctx context.Context, pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, tags map[string]string) error {
+	if pv.Spec.CSI == nil {
+		logWithCtx(ctx).Error("PV has no CSI source")
+		providerErrors.WithLabelValues("fsx").Inc()
+		return fmt.Errorf("PV has no CSI source")
+	}
+	fileSystemID := pv.Spec.CSI.VolumeHandle
+
+	sess, err := session.NewSession(&aws.Config{})
+	if err != nil {
+		panic(err)
+	}
+	svc := fsx.New(sess)
+
+	desc, err := svc.DescribeFileSystems(&fsx.DescribeFileSystemsInput{FileSystemIds: []*string{aws.String(fileSystemID)}})
+	if err != nil || len(desc.FileSystems) == 0 {
+		logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Cannot describe FSx filesystem")
+		providerErrors.WithLabelValues("fsx").Inc()
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("FSx filesystem %s not found", fileSystemID)
+	}
+	resourceARN := desc.FileSystems[0].ResourceARN
+
+	existing, err := svc.ListTagsForResource(&fsx.ListTagsForResourceInput{ResourceARN: resourceARN})
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Cannot get FSx tags")
+		providerErrors.WithLabelValues("fsx").Inc()
+		return err
+	}
+
+	var tagAdded bool
+	var firstErr error
+	for k, v := range tags {
+		if hasFSxTag(existing.Tags, k, v) {
+			tagsExisting.Inc()
+			continue
+		}
+		_, err := svc.TagResource(&fsx.TagResourceInput{
+			ResourceARN: resourceARN,
+			Tags: []*fsx.Tag{
+				{Key: aws.String(k), Value: aws.String(v)},
+			},
+		})
+		if err != nil {
+			logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Error creating FSx tags")
+			providerErrors.WithLabelValues("fsx").Inc()
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		tagsAdded.Inc()
+		tagAdded = true
+	}
+
+	currentManaged := ""
+	for _, t := range existing.Tags {
+		if *t.Key == managedTagsKey {
+			currentManaged = *t.Value
+		}
+	}
+	if newManaged := encodeManagedKeys(tags, managedTagsKey); newManaged != "" && newManaged != currentManaged {
+		_, err := svc.TagResource(&fsx.TagResourceInput{
+			ResourceARN: resourceARN,
+			Tags: []*fsx.Tag{
+				{Key: aws.String(managedTagsKey), Value: aws.String(newManaged)},
+			},
+		})
+		if err != nil {
+			logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Error updating FSx managed-tags marker")
+			providerErrors.WithLabelValues("fsx").Inc()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if tagAdded {
+		providerVolumesTagged.WithLabelValues("fsx").Inc()
+	}
+	return firstErr
+}
+
+func hasFSxTag(tags []*fsx.Tag, key string, value string) bool {
+	for _, t := range tags {
+		if *t.Key == key && *t.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (fsxProvider) resourceARN(ctx context.Context, svc *fsx.FSx, fileSystemID string) (*string, error) {
+	desc, err := svc.DescribeFileSystems(&fsx.DescribeFileSystemsInput{FileSystemIds: []*string{aws.String(fileSystemID)}})
+	if err != nil || len(desc.FileSystems) == 0 {
+		return nil, err
+	}
+	return desc.FileSystems[0].ResourceARN, nil
+}
+
+func (p fsxProvider) ManagedKeys(ctx context.Context, pv *v1.PersistentVolume) []string {
+	if pv.Spec.CSI == nil {
+		return nil
+	}
+	fileSystemID := pv.Spec.CSI.VolumeHandle
+
+	sess, err := session.NewSession(&aws.Config{})
+	if err != nil {
+		panic(err)
+	}
+	svc := fsx.New(sess)
+
+	resourceARN, err := p.resourceARN(ctx, svc, fileSystemID)
+	if err != nil || resourceARN == nil {
+		logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Cannot describe FSx filesystem")
+		providerErrors.WithLabelValues("fsx").Inc()
+		return nil
+	}
+
+	existing, err := svc.ListTagsForResource(&fsx.ListTagsForResourceInput{ResourceARN: resourceARN})
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Cannot get FSx tags")
+		providerErrors.WithLabelValues("fsx").Inc()
+		return nil
+	}
+	for _, t := range existing.Tags {
+		if *t.Key == managedTagsKey {
+			return decodeManagedKeys(*t.Value)
+		}
+	}
+	return nil
+}
+
+func (p fsxProvider) Untag(ctx context.Context, pv *v1.PersistentVolume, keys []string) {
+	if pv.Spec.CSI == nil || len(keys) == 0 {
+		return
+	}
+	fileSystemID := pv.Spec.CSI.VolumeHandle
+
+	sess, err := session.NewSession(&aws.Config{})
+	if err != nil {
+		panic(err)
+	}
+	svc := fsx.New(sess)
+
+	resourceARN, err := p.resourceARN(ctx, svc, fileSystemID)
+	if err != nil || resourceARN == nil {
+		logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Cannot describe FSx filesystem")
+		providerErrors.WithLabelValues("fsx").Inc()
+		return
+	}
+
+	tagKeys := make([]*string, 0, len(keys))
+	for _, k := range keys {
+		tagKeys = append(tagKeys, aws.String(k))
+	}
+	_, err = svc.UntagResource(&fsx.UntagResourceInput{ResourceARN: resourceARN, TagKeys: tagKeys})
+	if err != nil {
+		logWithCtx(ctx).WithError(err).WithField("fileSystemId", fileSystemID).Error("Error removing FSx tags")
+		providerErrors.WithLabelValues("fsx").Inc()
+		return
+	}
+	tagsRemoved.Add(float64(len(keys)))
+}
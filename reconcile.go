@@ -0,0 +1,82 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	prune         = kingpin.Flag("prune", "On every resync, remove previously-applied tags whose key is no longer present in the PVC's tag sources (drift correction)").Bool()
+	pruneOnDelete = kingpin.Flag("prune-on-delete", "On PVC deletion, remove the tags kube-tagger previously applied to its volume").Bool()
+
+	tagsRemoved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kubetagger_tags_removed",
+		Help: "Number of tags removed from volumes, on PVC deletion or by drift correction",
+	})
+	tagsDriftCorrected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kubetagger_tags_drift_corrected",
+		Help: "Number of stale managed tags removed because they no longer matched the PVC",
+	})
+)
+
+// managedTagsKey is written on every AWS volume kube-tagger tags, listing
+// the keys it currently manages, so a later reconcile or a PVC deletion
+// knows what it is safe to remove. GCE and Azure use their own variants
+// of this key since they don't allow "/" in label/tag names.
+const managedTagsKey = "kube-tagger/managed-tags"
+
+// encodeManagedKeys renders the keys of tags (excluding key itself) as a
+// managed-tags marker value.
+func encodeManagedKeys(tags map[string]string, key string) string {
+	out := make([]string, 0, len(tags))
+	for k := range tags {
+		if k == key {
+			continue
+		}
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+// decodeManagedKeys parses a managed-tags marker value back into its keys.
+func decodeManagedKeys(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// staleManagedKeys returns the entries of managed that are no longer
+// present in desired, i.e. tags kube-tagger applied previously but
+// shouldn't be managing anymore.
+func staleManagedKeys(managed []string, desired map[string]string) []string {
+	var stale []string
+	for _, k := range managed {
+		if _, ok := desired[k]; !ok {
+			stale = append(stale, k)
+		}
+	}
+	return stale
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeManagedKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+		key  string
+		want string
+	}{
+		{"empty", map[string]string{}, managedTagsKey, ""},
+		{"single tag", map[string]string{"Team": "platform"}, managedTagsKey, "Team"},
+		{
+			"sorted and excludes the marker key itself",
+			map[string]string{"Team": "platform", "Env": "prod", managedTagsKey: "stale"},
+			managedTagsKey,
+			"Env,Team",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeManagedKeys(tt.tags, tt.key); got != tt.want {
+				t.Errorf("encodeManagedKeys(%v, %q) = %q, want %q", tt.tags, tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeManagedKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{"empty", "", nil},
+		{"single key", "Team", []string{"Team"}},
+		{"multiple keys", "Env,Team", []string{"Env", "Team"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeManagedKeys(tt.value)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeManagedKeys(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleManagedKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		managed []string
+		desired map[string]string
+		want    []string
+	}{
+		{"nothing stale", []string{"Team"}, map[string]string{"Team": "platform"}, nil},
+		{"one stale key", []string{"Team", "Env"}, map[string]string{"Team": "platform"}, []string{"Env"}},
+		{"all stale", []string{"Team", "Env"}, map[string]string{}, []string{"Team", "Env"}},
+		{"no managed keys", nil, map[string]string{"Team": "platform"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := staleManagedKeys(tt.managed, tt.desired)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("staleManagedKeys(%v, %v) = %v, want %v", tt.managed, tt.desired, got, tt.want)
+			}
+		})
+	}
+}
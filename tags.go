@@ -0,0 +1,219 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+
+	v1 "k8s.io/api/core/v1"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const ignoreAnnotation = "k8s-pvc-tagger/ignore"
+
+var (
+	copyLabels   = kingpin.Flag("copy-labels", "Copy PVC labels as tags. Use '*' for all labels or a CSV of label keys").String()
+	defaultTags  = kingpin.Flag("default-tags", "JSON map of tags applied to every volume, overridden by per-PVC tags").String()
+	denyTagKeys  = kingpin.Flag("deny-tag-keys", "CSV of tag keys that cannot be set, unless --allow-all-tags is passed. Supports a trailing '*' wildcard").Default("kubernetes.io/*,KubernetesCluster").String()
+	allowAllTags = kingpin.Flag("allow-all-tags", "Disable the tag key deny-list").Bool()
+)
+
+// tagTemplateData is exposed to tag value templates so users can
+// reference the PVC being tagged, e.g. `OwnerID={{ .Namespace }}/{{ .Name }}`.
+type tagTemplateData struct {
+	Namespace string
+	Name      string
+	Labels    map[string]string
+}
+
+/*
+isIgnored returns true if the PVC carries the ignoreAnnotation, in
+which case kube-tagger should skip it entirely.
+*/
+func isIgnored(pvc *v1.PersistentVolumeClaim) bool {
+	return pvc.Annotations[ignoreAnnotation] == "true"
+}
+
+/*
+buildTags assembles the final tag set for pvc: --default-tags first,
+then PVC labels selected by --copy-labels, then the
+additional-resource-tags annotation, each source overriding the
+previous one. Tag values are expanded as Go templates before the
+deny-list is applied.
+*/
+func buildTags(pvc *v1.PersistentVolumeClaim) map[string]string {
+	tags := map[string]string{}
+
+	for k, v := range parseDefaultTags() {
+		tags[k] = v
+	}
+
+	for k, v := range copiedLabels(pvc) {
+		tags[k] = v
+	}
+
+	separator := ","
+	tagsToAdd := ""
+	for k, v := range pvc.Annotations {
+		if k == "volume.beta.kubernetes.io/additional-resource-tags-separator" {
+			separator = v
+		}
+		if k == "volume.beta.kubernetes.io/additional-resource-tags" {
+			tagsToAdd = v
+		}
+	}
+	for k, v := range parseTagString(tagsToAdd, separator) {
+		tags[k] = v
+	}
+
+	data := tagTemplateData{
+		Namespace: pvc.GetNamespace(),
+		Name:      pvc.GetName(),
+		Labels:    pvc.GetLabels(),
+	}
+	for k, v := range tags {
+		tags[k] = expandTagTemplate(v, data)
+	}
+
+	return denyListedTags(tags)
+}
+
+/*
+parseDefaultTags decodes the --default-tags flag, which is a JSON
+object of string to string, e.g. {"Team":"platform"}.
+*/
+func parseDefaultTags() map[string]string {
+	tags := map[string]string{}
+	if *defaultTags == "" {
+		return tags
+	}
+	if err := json.Unmarshal([]byte(*defaultTags), &tags); err != nil {
+		log.WithError(err).WithField("default-tags", *defaultTags).Error("Cannot parse --default-tags, ignoring it")
+		return map[string]string{}
+	}
+	return tags
+}
+
+/*
+copiedLabels returns the PVC labels selected by --copy-labels: all of
+them if the flag is "*", or only the ones named in its CSV value.
+*/
+func copiedLabels(pvc *v1.PersistentVolumeClaim) map[string]string {
+	tags := map[string]string{}
+	if *copyLabels == "" {
+		return tags
+	}
+	if *copyLabels == "*" {
+		for k, v := range pvc.GetLabels() {
+			tags[k] = v
+		}
+		return tags
+	}
+	for _, key := range strings.Split(*copyLabels, ",") {
+		if v, ok := pvc.GetLabels()[key]; ok {
+			tags[key] = v
+		}
+	}
+	return tags
+}
+
+/*
+parseTagString parses the "k=v<separator>k=v" format used by the
+additional-resource-tags annotation, skipping malformed entries.
+*/
+func parseTagString(tagsToAdd string, separator string) map[string]string {
+	tags := map[string]string{}
+	if tagsToAdd == "" {
+		return tags
+	}
+	for _, pair := range strings.Split(tagsToAdd, separator) {
+		t := strings.SplitN(pair, "=", 2)
+		if len(t) != 2 {
+			log.WithField("tag", pair).Error("Skipping malformed tag")
+			processingErrors.Inc()
+			continue
+		}
+		tags[t[0]] = t[1]
+	}
+	return tags
+}
+
+/*
+expandTagTemplate expands value as a Go text/template against data. If
+the template is invalid, or isn't actually a template, the original
+value is returned unchanged.
+*/
+func expandTagTemplate(value string, data tagTemplateData) string {
+	tmpl, err := template.New("tag").Parse(value)
+	if err != nil {
+		return value
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return value
+	}
+	return buf.String()
+}
+
+/*
+denyListedTags drops any tag keys matched by --deny-tag-keys, unless
+--allow-all-tags was passed. These are the keys kube-tagger (or the
+legacy in-tree volume plugin) writes itself; letting users override
+them would let a misconfigured PVC clobber controller-owned tags.
+*/
+func denyListedTags(tags map[string]string) map[string]string {
+	if *allowAllTags {
+		return tags
+	}
+	out := map[string]string{}
+	for k, v := range tags {
+		if isDeniedTagKey(k) {
+			log.WithField("tag", k).Warn("Tag key is denied, skipping")
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func isDeniedTagKey(key string) bool {
+	if *allowAllTags {
+		return false
+	}
+	for _, pattern := range strings.Split(*denyTagKeys, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+			continue
+		}
+		if key == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2019 Sergio Rua
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseTagString(t *testing.T) {
+	tests := []struct {
+		name      string
+		tagsToAdd string
+		separator string
+		want      map[string]string
+	}{
+		{"empty", "", ",", map[string]string{}},
+		{"single pair", "Team=platform", ",", map[string]string{"Team": "platform"}},
+		{"multiple pairs", "Team=platform,Env=prod", ",", map[string]string{"Team": "platform", "Env": "prod"}},
+		{"custom separator", "Team=platform;Env=prod", ";", map[string]string{"Team": "platform", "Env": "prod"}},
+		{"malformed entry skipped", "Team=platform,bogus", ",", map[string]string{"Team": "platform"}},
+		{"value contains equals sign", "Query=a=b", ",", map[string]string{"Query": "a=b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseTagString(tt.tagsToAdd, tt.separator)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTagString(%q, %q) = %v, want %v", tt.tagsToAdd, tt.separator, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsDeniedTagKey(t *testing.T) {
+	origDenyTagKeys, origAllowAllTags := *denyTagKeys, *allowAllTags
+	defer func() {
+		*denyTagKeys, *allowAllTags = origDenyTagKeys, origAllowAllTags
+	}()
+	*denyTagKeys = "kubernetes.io/*,KubernetesCluster"
+	*allowAllTags = false
+
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"exact match", "KubernetesCluster", true},
+		{"wildcard match", "kubernetes.io/cluster/foo", true},
+		{"no match", "Team", false},
+		{"prefix without trailing segment does not match", "kubernetes.io", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isDeniedTagKey(tt.key); got != tt.want {
+				t.Errorf("isDeniedTagKey(%q) = %v, want %v", tt.key, got, tt.want)
+			}
+		})
+	}
+
+	*allowAllTags = true
+	if isDeniedTagKey("KubernetesCluster") {
+		t.Error("isDeniedTagKey() = true with --allow-all-tags set, want false")
+	}
+}
+
+func TestExpandTagTemplate(t *testing.T) {
+	data := tagTemplateData{
+		Namespace: "default",
+		Name:      "my-pvc",
+		Labels:    map[string]string{"team": "platform"},
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"plain value", "static-value", "static-value"},
+		{"namespace and name", "{{ .Namespace }}/{{ .Name }}", "default/my-pvc"},
+		{"label reference", "{{ .Labels.team }}", "platform"},
+		{"invalid template falls back to literal", "{{ .Name", "{{ .Name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expandTagTemplate(tt.value, data); got != tt.want {
+				t.Errorf("expandTagTemplate(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildTags(t *testing.T) {
+	origDefaultTags, origCopyLabels := *defaultTags, *copyLabels
+	origDenyTagKeys, origAllowAllTags := *denyTagKeys, *allowAllTags
+	defer func() {
+		*defaultTags, *copyLabels = origDefaultTags, origCopyLabels
+		*denyTagKeys, *allowAllTags = origDenyTagKeys, origAllowAllTags
+	}()
+
+	*defaultTags = `{"Team":"platform"}`
+	*copyLabels = "app"
+	*denyTagKeys = "kubernetes.io/*,KubernetesCluster"
+	*allowAllTags = false
+
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "my-pvc",
+			Labels:    map[string]string{"app": "web", "other": "ignored"},
+			Annotations: map[string]string{
+				"volume.beta.kubernetes.io/additional-resource-tags": "Env=prod,Owner={{ .Namespace }}",
+			},
+		},
+	}
+
+	got := buildTags(pvc)
+	want := map[string]string{
+		"Team":  "platform",
+		"app":   "web",
+		"Env":   "prod",
+		"Owner": "default",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTags() = %v, want %v", got, want)
+	}
+}
+
+func TestBuildTagsAppliesDenyList(t *testing.T) {
+	origDefaultTags, origCopyLabels := *defaultTags, *copyLabels
+	origDenyTagKeys, origAllowAllTags := *denyTagKeys, *allowAllTags
+	defer func() {
+		*defaultTags, *copyLabels = origDefaultTags, origCopyLabels
+		*denyTagKeys, *allowAllTags = origDenyTagKeys, origAllowAllTags
+	}()
+
+	*defaultTags = ""
+	*copyLabels = ""
+	*denyTagKeys = "kubernetes.io/*,KubernetesCluster"
+	*allowAllTags = false
+
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				"volume.beta.kubernetes.io/additional-resource-tags": "KubernetesCluster=my-cluster,Team=platform",
+			},
+		},
+	}
+
+	got := buildTags(pvc)
+	want := map[string]string{"Team": "platform"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildTags() = %v, want %v", got, want)
+	}
+}